@@ -6,8 +6,8 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	_ "embed"
+	"encoding/base64"
 	"encoding/hex"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"os"
@@ -21,8 +21,7 @@ import (
 	C "github.com/metacubex/mihomo/constant"
 )
 
-var trustCerts []*x509.Certificate
-var globalCertPool *x509.CertPool
+var globalSPKIPins []*[32]byte
 var mutex sync.RWMutex
 var errNotMatch = errors.New("certificate fingerprints do not match")
 
@@ -31,93 +30,106 @@ var _CaCertificates []byte
 var DisableEmbedCa, _ = strconv.ParseBool(os.Getenv("DISABLE_EMBED_CA"))
 var DisableSystemCa, _ = strconv.ParseBool(os.Getenv("DISABLE_SYSTEM_CA"))
 
-func AddCertificateKeyPair(certificate string, privateKey string) {
+// defaultTrustStore returns the "default" scope created in truststore.go's
+// init, the one real trust store these package-level functions are thin
+// wrappers over - so a cert added via AddCertificate and one added via
+// GetTrustStore("default").AddPEM end up in the same pool instead of two
+// that silently diverge.
+func defaultTrustStore() *TrustStore {
+	ts, _ := GetTrustStore("default")
+	return ts
+}
 
+// AddCertificateKeyPair adds every certificate in the pair's chain to the
+// default trust store scope.
+func AddCertificateKeyPair(certificate string, privateKey string) {
 	certKeyPair, err := CN.ParseCert(certificate, privateKey, C.Path)
 	if err != nil {
 		log.Warnln("failed to parse certificate and privateKey: %v", err)
 	}
+	var certs []*x509.Certificate
 	for _, certPEM := range certKeyPair.Certificate {
 		// []byte to x509.Certificate
 		customCertificate, err := x509.ParseCertificate(certPEM)
 		if err != nil {
 			log.Warnln("failed to parse x509 certificate: %v", err)
+			continue
 		}
-		trustCerts = append(trustCerts, customCertificate)
-		globalCertPool.AddCert(customCertificate)
+		certs = append(certs, customCertificate)
 	}
+	defaultTrustStore().addCerts(certs)
 }
+
+// AddCertificate adds certificate (a single PEM-encoded certificate) to the
+// default trust store scope.
 func AddCertificate(certificate string) error {
-	mutex.Lock()
-	defer mutex.Unlock()
 	if certificate == "" {
 		return fmt.Errorf("certificate is empty")
 	}
-
-	block, _ := pem.Decode([]byte(certificate))
-	if block == nil {
-		log.Fatalln("failed to parse PEM block containing the certificate")
-		return fmt.Errorf("decode certificate failed")
-	}
-
-	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
-		trustCerts = append(trustCerts, cert)
-		globalCertPool.AddCert(cert)
-		return nil
-	} else {
-		return fmt.Errorf("add certificate failed")
-	}
+	return defaultTrustStore().AddPEM(certificate)
 }
 
-func initializeCertPool() {
-	var err error
-	if DisableSystemCa {
-		globalCertPool = x509.NewCertPool()
-	} else {
-		globalCertPool, err = x509.SystemCertPool()
-		if err != nil {
-			globalCertPool = x509.NewCertPool()
-		}
-	}
-	for _, cert := range trustCerts {
-		globalCertPool.AddCert(cert)
-	}
-	if !DisableEmbedCa {
-		globalCertPool.AppendCertsFromPEM(_CaCertificates)
+// ResetCertificate drops every user-added cert from the default trust store
+// scope, falling back to just its system/embedded roots.
+func ResetCertificate() {
+	if err := ResetCertificateScope("default"); err != nil {
+		log.Warnln("failed to reset default trust store: %v", err)
 	}
 }
 
-func ResetCertificate() {
-	mutex.Lock()
-	defer mutex.Unlock()
-	trustCerts = nil
-	initializeCertPool()
+func getCertPool() *x509.CertPool {
+	ts := defaultTrustStore()
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.pool
 }
 
-func getCertPool() *x509.CertPool {
-	if globalCertPool == nil {
-		mutex.Lock()
-		defer mutex.Unlock()
-		if globalCertPool != nil {
-			return globalCertPool
+// chainVerifyConnection composes two optional tls.Config.VerifyConnection
+// callbacks so that layering more than one post-handshake check (trust-store
+// scope pinning, revocation, require-sct) onto the same config never
+// silently drops an earlier one - each later layer runs only once the
+// earlier layer(s) already accepted the connection.
+func chainVerifyConnection(first, second func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	if first == nil {
+		return second
+	}
+	if second == nil {
+		return first
+	}
+	return func(cs tls.ConnectionState) error {
+		if err := first(cs); err != nil {
+			return err
 		}
-		initializeCertPool()
+		return second(cs)
 	}
-	return globalCertPool
 }
 
-func verifyFingerprint(fingerprint *[32]byte) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+// verifyPeerCertificateAndFingerprints matches a chain if any presented
+// certificate's full DER hash is in fingerprints, or its SPKI hash is in
+// spkiPins.
+func verifyPeerCertificateAndFingerprints(fingerprints []*[32]byte, spkiPins []*[32]byte) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 		// ssl pining
 		for i := range rawCerts {
 			rawCert := rawCerts[i]
 			cert, err := x509.ParseCertificate(rawCert)
-			if err == nil {
-				hash := sha256.Sum256(cert.Raw)
+			if err != nil {
+				continue
+			}
+
+			hash := sha256.Sum256(cert.Raw)
+			for _, fingerprint := range fingerprints {
 				if bytes.Equal(fingerprint[:], hash[:]) {
 					return nil
 				}
 			}
+
+			spkiHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range spkiPins {
+				if bytes.Equal(pin[:], spkiHash[:]) {
+					return nil
+				}
+			}
 		}
 		return errNotMatch
 	}
@@ -136,6 +148,44 @@ func convertFingerprint(fingerprint string) (*[32]byte, error) {
 	return (*[32]byte)(fpByte), nil
 }
 
+// convertSPKIPin accepts the `pin-sha256="..."` form used by browser devtools
+// as well as bare base64/hex encodings of a SHA-256 SPKI hash.
+func convertSPKIPin(pin string) (*[32]byte, error) {
+	pin = strings.TrimSpace(pin)
+	if strings.HasPrefix(pin, "pin-sha256=") {
+		pin = strings.Trim(strings.TrimPrefix(pin, "pin-sha256="), `"`)
+	}
+
+	if pinByte, err := base64.StdEncoding.DecodeString(pin); err == nil && len(pinByte) == 32 {
+		return (*[32]byte)(pinByte), nil
+	}
+
+	pinByte, err := hex.DecodeString(strings.Replace(pin, ":", "", -1))
+	if err != nil {
+		return nil, fmt.Errorf("spki pin is neither valid base64 nor hex: %w", err)
+	}
+	if len(pinByte) != 32 {
+		return nil, fmt.Errorf("spki pin length error,need sha256 spki pin")
+	}
+	return (*[32]byte)(pinByte), nil
+}
+
+// AddSPKIPin records a process-wide pin of a SHA-256 SubjectPublicKeyInfo
+// hash in globalSPKIPins. None of the TLS configs built by this package read
+// that list; GetSpecifiedSPKIPinTLSConfig and GetSpecifiedPinsTLSConfig
+// enforce only the pins passed to them.
+func AddSPKIPin(pin string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	pinByte, err := convertSPKIPin(pin)
+	if err != nil {
+		return err
+	}
+	globalSPKIPins = append(globalSPKIPins, pinByte)
+	return nil
+}
+
 // GetTLSConfig specified fingerprint, customCA and customCAString
 func GetTLSConfig(tlsConfig *tls.Config, fingerprint string, customCA string, customCAString string) (*tls.Config, error) {
 	if tlsConfig == nil {
@@ -167,7 +217,7 @@ func GetTLSConfig(tlsConfig *tls.Config, fingerprint string, customCA string, cu
 			return nil, err
 		}
 		tlsConfig = GetGlobalTLSConfig(tlsConfig)
-		tlsConfig.VerifyPeerCertificate = verifyFingerprint(fingerprintBytes)
+		tlsConfig.VerifyPeerCertificate = verifyPeerCertificateAndFingerprints([]*[32]byte{fingerprintBytes}, nil)
 		tlsConfig.InsecureSkipVerify = true
 	}
 	return tlsConfig, nil
@@ -178,6 +228,56 @@ func GetSpecifiedFingerprintTLSConfig(tlsConfig *tls.Config, fingerprint string)
 	return GetTLSConfig(tlsConfig, fingerprint, "", "")
 }
 
+// GetSpecifiedSPKIPinTLSConfig pins on the SHA-256 hash of the peer's
+// SubjectPublicKeyInfo, so that rotating a leaf certificate while keeping the
+// same key pair doesn't require the user to update their pinned value.
+func GetSpecifiedSPKIPinTLSConfig(tlsConfig *tls.Config, pin string) (*tls.Config, error) {
+	pinBytes, err := convertSPKIPin(pin)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig = GetGlobalTLSConfig(tlsConfig)
+	tlsConfig.VerifyPeerCertificate = verifyPeerCertificateAndFingerprints(nil, []*[32]byte{pinBytes})
+	tlsConfig.InsecureSkipVerify = true
+	return tlsConfig, nil
+}
+
+// GetSpecifiedPinsTLSConfig lets a proxy config specify multiple pins at
+// once, mixing full-certificate fingerprints and SPKI pins freely; a chain
+// matches if any presented certificate matches any pin. An entry in the
+// `pin-sha256=` form is an SPKI pin; any other entry that parses as a hex
+// (optionally colon-separated) 32-byte value is a certificate fingerprint,
+// and the rest are decoded as SPKI pins (base64, or hex).
+func GetSpecifiedPinsTLSConfig(tlsConfig *tls.Config, pins []string) (*tls.Config, error) {
+	var fingerprintBytes []*[32]byte
+	var spkiBytes []*[32]byte
+	for _, pin := range pins {
+		trimmed := strings.TrimSpace(pin)
+		if strings.HasPrefix(trimmed, "pin-sha256=") {
+			pb, err := convertSPKIPin(trimmed)
+			if err != nil {
+				return nil, err
+			}
+			spkiBytes = append(spkiBytes, pb)
+			continue
+		}
+		if fb, err := convertFingerprint(trimmed); err == nil {
+			fingerprintBytes = append(fingerprintBytes, fb)
+			continue
+		}
+		pb, err := convertSPKIPin(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("pin %q is neither a valid fingerprint nor SPKI pin: %w", pin, err)
+		}
+		spkiBytes = append(spkiBytes, pb)
+	}
+
+	tlsConfig = GetGlobalTLSConfig(tlsConfig)
+	tlsConfig.VerifyPeerCertificate = verifyPeerCertificateAndFingerprints(fingerprintBytes, spkiBytes)
+	tlsConfig.InsecureSkipVerify = true
+	return tlsConfig, nil
+}
+
 func GetGlobalTLSConfig(tlsConfig *tls.Config) *tls.Config {
 	tlsConfig, _ = GetTLSConfig(tlsConfig, "", "", "")
 	return tlsConfig
@@ -0,0 +1,71 @@
+package ca
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+func TestConvertFingerprint(t *testing.T) {
+	sum := sha256.Sum256([]byte("test certificate"))
+
+	for name, in := range map[string]string{
+		"plain hex":  hex.EncodeToString(sum[:]),
+		"colon hex":  colonize(hex.EncodeToString(sum[:])),
+		"whitespace": " " + hex.EncodeToString(sum[:]) + " ",
+	} {
+		got, err := convertFingerprint(in)
+		if err != nil {
+			t.Fatalf("convertFingerprint(%s): %v", name, err)
+		}
+		if !bytes.Equal(got[:], sum[:]) {
+			t.Fatalf("convertFingerprint(%s): got %x, want %x", name, got, sum)
+		}
+	}
+
+	for name, in := range map[string]string{
+		"not hex":     "not-a-hex-string",
+		"wrong length": hex.EncodeToString(sum[:16]),
+	} {
+		if _, err := convertFingerprint(in); err == nil {
+			t.Errorf("convertFingerprint(%s): expected error", name)
+		}
+	}
+}
+
+func TestConvertSPKIPin(t *testing.T) {
+	sum := sha256.Sum256([]byte("test spki"))
+	b64 := base64.StdEncoding.EncodeToString(sum[:])
+
+	for name, in := range map[string]string{
+		"bare base64":     b64,
+		"pin-sha256 form": `pin-sha256="` + b64 + `"`,
+		"hex":             hex.EncodeToString(sum[:]),
+		"colon hex":       colonize(hex.EncodeToString(sum[:])),
+	} {
+		got, err := convertSPKIPin(in)
+		if err != nil {
+			t.Fatalf("convertSPKIPin(%s): %v", name, err)
+		}
+		if !bytes.Equal(got[:], sum[:]) {
+			t.Fatalf("convertSPKIPin(%s): got %x, want %x", name, got, sum)
+		}
+	}
+
+	if _, err := convertSPKIPin("neither valid base64 nor hex!!"); err == nil {
+		t.Error("convertSPKIPin: expected error for garbage input")
+	}
+}
+
+func colonize(hexStr string) string {
+	var out []byte
+	for i := 0; i < len(hexStr); i += 2 {
+		if i > 0 {
+			out = append(out, ':')
+		}
+		out = append(out, hexStr[i], hexStr[i+1])
+	}
+	return string(out)
+}
@@ -0,0 +1,505 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	_ "embed"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	log "github.com/metacubex/mihomo/log"
+)
+
+// ct-logs.json is a bootstrap list of trusted CT log public keys, in the
+// same spirit as ca-certificates.crt; it should be regenerated from the
+// operators' published combined log list before a release.
+//
+//go:embed ct-logs.json
+var _CTLogs []byte
+var DisableEmbedCTLogs, _ = strconv.ParseBool(os.Getenv("DISABLE_EMBED_CT_LOGS"))
+
+// sctExtensionOID is the X.509v3 extension OID (RFC 6962 §3.3) a CA stamps
+// into the final certificate to carry its embedded SCTs.
+var sctExtensionOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// poisonExtensionOID is the critical "poison" extension (RFC 6962 §3.1) the
+// CA puts in the precertificate it submits to logs, in place of the SCT
+// extension above.
+var poisonExtensionOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+
+type ctLogEntry struct {
+	LogID    string `json:"log_id"`
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+}
+
+type ctLog struct {
+	operator string
+	pub      crypto.PublicKey
+}
+
+var (
+	ctLogsMutex sync.RWMutex
+	trustedLogs = make(map[[32]byte]ctLog)
+)
+
+func init() {
+	if DisableEmbedCTLogs {
+		return
+	}
+	var entries []ctLogEntry
+	if err := json.Unmarshal(_CTLogs, &entries); err != nil {
+		log.Warnln("failed to parse embedded ct-logs.json: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		if err := addCTLog(entry.LogID, entry.Key, entry.Operator); err != nil {
+			log.Warnln("failed to load embedded CT log %s: %v", entry.LogID, err)
+		}
+	}
+}
+
+// AddCTLog registers a trusted CT log's public key, used to verify the
+// signatures on SCTs it issued. logID and pubKey are both base64.
+func AddCTLog(logID, pubKey string) error {
+	return addCTLog(logID, pubKey, "")
+}
+
+func addCTLog(logID, pubKey, operator string) error {
+	idBytes, err := base64.StdEncoding.DecodeString(logID)
+	if err != nil {
+		return fmt.Errorf("decode log id: %w", err)
+	}
+	if len(idBytes) != 32 {
+		return fmt.Errorf("log id must be the 32-byte SHA-256 hash of the log's public key")
+	}
+
+	keyBytes, err := base64.StdEncoding.DecodeString(pubKey)
+	if err != nil {
+		return fmt.Errorf("decode log public key: %w", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(keyBytes)
+	if err != nil {
+		return fmt.Errorf("parse log public key: %w", err)
+	}
+
+	ctLogsMutex.Lock()
+	defer ctLogsMutex.Unlock()
+	trustedLogs[[32]byte(idBytes)] = ctLog{operator: operator, pub: pub}
+	return nil
+}
+
+// signedCertificateTimestamp is an RFC 6962 §3.2 SCT.
+type signedCertificateTimestamp struct {
+	version    byte
+	logID      [32]byte
+	timestamp  uint64
+	extensions []byte
+	hashAlg    byte
+	sigAlg     byte
+	signature  []byte
+}
+
+// parseSCTList parses a SignedCertificateTimestampList (RFC 6962 §3.3): a
+// 2-byte length prefix followed by length-prefixed individual SCTs.
+func parseSCTList(data []byte) ([]signedCertificateTimestamp, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("sct list too short")
+	}
+	listLen := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) != listLen {
+		return nil, fmt.Errorf("sct list length mismatch")
+	}
+
+	var out []signedCertificateTimestamp
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("truncated sct entry")
+		}
+		sctLen := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if len(data) < sctLen {
+			return nil, fmt.Errorf("truncated sct entry")
+		}
+		sct, err := parseSCT(data[:sctLen])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sct)
+		data = data[sctLen:]
+	}
+	return out, nil
+}
+
+func parseSCT(data []byte) (signedCertificateTimestamp, error) {
+	var sct signedCertificateTimestamp
+	if len(data) < 1+32+8+2 {
+		return sct, fmt.Errorf("sct too short")
+	}
+	sct.version = data[0]
+	copy(sct.logID[:], data[1:33])
+	sct.timestamp = binary.BigEndian.Uint64(data[33:41])
+	data = data[41:]
+
+	extLen := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < extLen {
+		return sct, fmt.Errorf("truncated sct extensions")
+	}
+	sct.extensions = data[:extLen]
+	data = data[extLen:]
+
+	if len(data) < 4 {
+		return sct, fmt.Errorf("truncated sct signature header")
+	}
+	sct.hashAlg = data[0]
+	sct.sigAlg = data[1]
+	sigLen := int(binary.BigEndian.Uint16(data[2:4]))
+	data = data[4:]
+	if len(data) != sigLen {
+		return sct, fmt.Errorf("sct signature length mismatch")
+	}
+	sct.signature = data
+	return sct, nil
+}
+
+// tbsCertificateForCT mirrors the ASN.1 shape of TBSCertificate closely
+// enough to drop/replace the SCT extension while leaving every other byte
+// untouched, which is required to reconstruct the exact precertificate
+// TBSCertificate that a CT log originally signed over.
+type tbsCertificateForCT struct {
+	Raw                asn1.RawContent
+	Version            int `asn1:"optional,explicit,default:0,tag:0"`
+	SerialNumber       asn1.RawValue
+	SignatureAlgorithm asn1.RawValue
+	Issuer             asn1.RawValue
+	Validity           asn1.RawValue
+	Subject            asn1.RawValue
+	PublicKey          asn1.RawValue
+	UniqueID           asn1.RawValue    `asn1:"optional,tag:1"`
+	SubjectUniqueID    asn1.RawValue    `asn1:"optional,tag:2"`
+	Extensions         []pkix.Extension `asn1:"optional,explicit,tag:3"`
+}
+
+// buildPrecertTBS reconstructs the TBSCertificate bytes the CA submitted to
+// CT logs, by swapping the final cert's SCT-list extension back out for the
+// poison extension the precertificate carried in its place.
+func buildPrecertTBS(cert *x509.Certificate) ([]byte, error) {
+	var tbs tbsCertificateForCT
+	if _, err := asn1.Unmarshal(cert.RawTBSCertificate, &tbs); err != nil {
+		return nil, fmt.Errorf("parse tbsCertificate: %w", err)
+	}
+
+	found := false
+	for i, ext := range tbs.Extensions {
+		if ext.Id.Equal(sctExtensionOID) {
+			tbs.Extensions[i] = pkix.Extension{
+				Id:       poisonExtensionOID,
+				Critical: true,
+				Value:    []byte{0x05, 0x00}, // ASN.1 NULL
+			}
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("certificate has no embedded SCT extension")
+	}
+
+	// asn1.Marshal re-emits a non-empty RawContent verbatim, which would
+	// return the original bytes and drop the swapped-in extension.
+	tbs.Raw = nil
+	return asn1.Marshal(tbs)
+}
+
+// sctSignedData reconstructs the "digitally-signed" byte string (RFC 6962
+// §3.2) an SCT's signature was computed over.
+func sctSignedData(sct signedCertificateTimestamp, entryType uint16, signedEntry []byte) []byte {
+	var buf []byte
+	buf = append(buf, sct.version)
+	buf = append(buf, 0) // signature_type = certificate_timestamp
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, sct.timestamp)
+	buf = append(buf, ts...)
+	et := make([]byte, 2)
+	binary.BigEndian.PutUint16(et, entryType)
+	buf = append(buf, et...)
+	buf = append(buf, signedEntry...)
+	extLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(extLen, uint16(len(sct.extensions)))
+	buf = append(buf, extLen...)
+	buf = append(buf, sct.extensions...)
+	return buf
+}
+
+func uint24(n int) []byte {
+	return []byte{byte(n >> 16), byte(n >> 8), byte(n)}
+}
+
+func verifySCTSignature(sct signedCertificateTimestamp, signedData []byte, pub crypto.PublicKey) error {
+	digest := sha256.Sum256(signedData)
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], sct.signature) {
+			return fmt.Errorf("ecdsa signature verification failed")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sct.signature)
+	default:
+		return fmt.Errorf("unsupported CT log key type %T", pub)
+	}
+}
+
+// verifiedSCT is a single SCT that passed signature verification.
+type verifiedSCT struct {
+	logID    [32]byte
+	operator string
+}
+
+func verifyEmbeddedSCTs(cert *x509.Certificate, issuer *x509.Certificate) ([]verifiedSCT, error) {
+	var ext []byte
+	for _, e := range cert.Extensions {
+		if e.Id.Equal(sctExtensionOID) {
+			ext = e.Value
+			break
+		}
+	}
+	if ext == nil {
+		return nil, nil
+	}
+
+	// The extension OCTET STRING contains another OCTET STRING wrapping the
+	// SignedCertificateTimestampList.
+	var inner []byte
+	if _, err := asn1.Unmarshal(ext, &inner); err != nil {
+		return nil, fmt.Errorf("unwrap sct extension: %w", err)
+	}
+
+	scts, err := parseSCTList(inner)
+	if err != nil {
+		return nil, fmt.Errorf("parse embedded scts: %w", err)
+	}
+
+	tbs, err := buildPrecertTBS(cert)
+	if err != nil {
+		return nil, err
+	}
+	issuerKeyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+
+	signedEntry := append(append([]byte{}, issuerKeyHash[:]...), append(uint24(len(tbs)), tbs...)...)
+
+	return verifySCTs(scts, 1, signedEntry)
+}
+
+func verifyDeliveredSCTs(cert *x509.Certificate, raw []byte) ([]verifiedSCT, error) {
+	scts, err := parseSCTList(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parse scts: %w", err)
+	}
+	signedEntry := append(uint24(len(cert.Raw)), cert.Raw...)
+	return verifySCTs(scts, 0, signedEntry)
+}
+
+// verifyTLSExtensionSCTs validates SCTs the peer delivered via the TLS
+// "signed_certificate_timestamp" extension (RFC 6962 §3.3), which
+// crypto/tls already splits into individual decoded SCTs, unlike the
+// embedded and OCSP-stapled sources which hand over a concatenated
+// SignedCertificateTimestampList.
+func verifyTLSExtensionSCTs(cert *x509.Certificate, raw [][]byte) ([]verifiedSCT, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	scts := make([]signedCertificateTimestamp, 0, len(raw))
+	for _, entry := range raw {
+		sct, err := parseSCT(entry)
+		if err != nil {
+			return nil, fmt.Errorf("parse tls extension sct: %w", err)
+		}
+		scts = append(scts, sct)
+	}
+
+	signedEntry := append(uint24(len(cert.Raw)), cert.Raw...)
+	return verifySCTs(scts, 0, signedEntry)
+}
+
+func verifySCTs(scts []signedCertificateTimestamp, entryType uint16, signedEntry []byte) ([]verifiedSCT, error) {
+	var verified []verifiedSCT
+	ctLogsMutex.RLock()
+	defer ctLogsMutex.RUnlock()
+
+	for _, sct := range scts {
+		entry, ok := trustedLogs[sct.logID]
+		if !ok {
+			log.Debugln("sct from unknown log %s, ignoring", hex.EncodeToString(sct.logID[:]))
+			continue
+		}
+		signedData := sctSignedData(sct, entryType, signedEntry)
+		if err := verifySCTSignature(sct, signedData, entry.pub); err != nil {
+			log.Debugln("sct signature verification failed for log %s: %v", hex.EncodeToString(sct.logID[:]), err)
+			continue
+		}
+		verified = append(verified, verifiedSCT{logID: sct.logID, operator: entry.operator})
+	}
+	return verified, nil
+}
+
+func countDistinctOperators(scts []verifiedSCT) int {
+	seen := make(map[string]struct{})
+	for _, s := range scts {
+		key := s.operator
+		if key == "" {
+			key = hex.EncodeToString(s.logID[:])
+		}
+		seen[key] = struct{}{}
+	}
+	return len(seen)
+}
+
+// applySCTCheck wires require-sct enforcement into tlsConfig, counting SCTs
+// gathered from all three RFC 6962 delivery mechanisms: embedded in the
+// certificate, stapled to the OCSP response, and sent via the TLS
+// "signed_certificate_timestamp" extension. Only the embedded source needs
+// a verified issuer (to recompute the precertificate TBS against the
+// issuer's key hash), so - unlike applyRevocationCheck - it still runs when
+// InsecureSkipVerify is set for a fingerprint/SPKI pin; it just skips the
+// embedded check in that case, same as if the certificate carried no SCT
+// extension at all. Like applyRevocationCheck, it composes onto any
+// VerifyConnection already set instead of replacing it, so a proxy can
+// combine require-sct with revocation checking.
+func applySCTCheck(tlsConfig *tls.Config, minSCTCount int) *tls.Config {
+	if minSCTCount <= 0 {
+		minSCTCount = 2
+	}
+
+	tlsConfig.VerifyConnection = chainVerifyConnection(tlsConfig.VerifyConnection, func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("require-sct: no peer certificate to check SCTs against")
+		}
+		leaf := cs.PeerCertificates[0]
+
+		var all []verifiedSCT
+		if len(cs.VerifiedChains) > 0 && len(cs.VerifiedChains[0]) >= 2 {
+			issuer := cs.VerifiedChains[0][1]
+			if embedded, err := verifyEmbeddedSCTs(leaf, issuer); err == nil {
+				all = append(all, embedded...)
+			} else {
+				log.Debugln("require-sct: embedded sct verification failed: %v", err)
+			}
+		}
+
+		if len(cs.OCSPResponse) > 0 {
+			if resp, err := parseOCSPSCTExtension(cs.OCSPResponse); err == nil && resp != nil {
+				if delivered, err := verifyDeliveredSCTs(leaf, resp); err == nil {
+					all = append(all, delivered...)
+				}
+			}
+		}
+
+		if tlsDelivered, err := verifyTLSExtensionSCTs(leaf, cs.SignedCertificateTimestamps); err == nil {
+			all = append(all, tlsDelivered...)
+		} else {
+			log.Debugln("require-sct: tls extension sct verification failed: %v", err)
+		}
+
+		if countDistinctOperators(all) < minSCTCount {
+			return fmt.Errorf("require-sct: only %d verified SCT(s) from distinct operators, need %d", countDistinctOperators(all), minSCTCount)
+		}
+		return nil
+	})
+	return tlsConfig
+}
+
+// ocspSCTExtensionOID is the OCSP single-response extension (RFC 6962 §3.3)
+// an OCSP responder can use to deliver SCTs it was given at issuance time.
+var ocspSCTExtensionOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 5}
+
+// golang.org/x/crypto/ocsp doesn't expose raw BasicOCSPResponse extensions,
+// so these mirror just enough of RFC 6960 to reach singleResponse.extensions.
+type ocspResponseASN1 struct {
+	Status       asn1.Enumerated
+	ResponseByte ocspResponseBytes `asn1:"explicit,tag:0"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type basicOCSPResponse struct {
+	TBSResponseData    responseData
+	SignatureAlgorithm asn1.RawValue
+	Signature          asn1.BitString
+	Certs              []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type responseData struct {
+	Raw           asn1.RawContent
+	Version       int `asn1:"optional,explicit,default:0,tag:0"`
+	ResponderID   asn1.RawValue
+	ProducedAt    asn1.RawValue
+	Responses     []singleResponse
+	ResponseExtns []pkix.Extension `asn1:"optional,explicit,tag:1"`
+}
+
+type singleResponse struct {
+	CertID     asn1.RawValue
+	CertStatus asn1.RawValue
+	ThisUpdate asn1.RawValue
+	NextUpdate asn1.RawValue    `asn1:"optional,explicit,tag:0"`
+	Extensions []pkix.Extension `asn1:"optional,explicit,tag:1"`
+}
+
+// parseOCSPSCTExtension best-effort extracts a stapled SCT list from a raw
+// OCSP response's first single-response extensions. Any parse failure is
+// treated as "no stapled SCTs" by the caller rather than a hard error.
+func parseOCSPSCTExtension(der []byte) ([]byte, error) {
+	var resp ocspResponseASN1
+	if _, err := asn1.Unmarshal(der, &resp); err != nil {
+		return nil, fmt.Errorf("parse ocsp response: %w", err)
+	}
+
+	var basic basicOCSPResponse
+	if _, err := asn1.Unmarshal(resp.ResponseByte.Response, &basic); err != nil {
+		return nil, fmt.Errorf("parse basic ocsp response: %w", err)
+	}
+	if len(basic.TBSResponseData.Responses) == 0 {
+		return nil, fmt.Errorf("ocsp response has no single responses")
+	}
+
+	for _, ext := range basic.TBSResponseData.Responses[0].Extensions {
+		if ext.Id.Equal(ocspSCTExtensionOID) {
+			var inner []byte
+			if _, err := asn1.Unmarshal(ext.Value, &inner); err != nil {
+				return nil, fmt.Errorf("unwrap ocsp sct extension: %w", err)
+			}
+			return inner, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetCTVerifiedTLSConfig behaves like GetTLSConfig but additionally requires
+// at least minSCTCount valid SCTs (from distinct log operators) before the
+// handshake is accepted.
+func GetCTVerifiedTLSConfig(tlsConfig *tls.Config, fingerprint string, customCA string, customCAString string, minSCTCount int) (*tls.Config, error) {
+	tlsConfig, err := GetTLSConfig(tlsConfig, fingerprint, customCA, customCAString)
+	if err != nil {
+		return nil, err
+	}
+	return applySCTCheck(tlsConfig, minSCTCount), nil
+}
@@ -0,0 +1,163 @@
+package ca
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// encodeSCT builds the wire format of a single SCT (RFC 6962 §3.2) for test
+// fixtures, the inverse of parseSCT.
+func encodeSCT(sct signedCertificateTimestamp) []byte {
+	var buf []byte
+	buf = append(buf, sct.version)
+	buf = append(buf, sct.logID[:]...)
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, sct.timestamp)
+	buf = append(buf, ts...)
+	extLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(extLen, uint16(len(sct.extensions)))
+	buf = append(buf, extLen...)
+	buf = append(buf, sct.extensions...)
+	buf = append(buf, sct.hashAlg, sct.sigAlg)
+	sigLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(sigLen, uint16(len(sct.signature)))
+	buf = append(buf, sigLen...)
+	buf = append(buf, sct.signature...)
+	return buf
+}
+
+func encodeSCTList(scts [][]byte) []byte {
+	var body []byte
+	for _, sct := range scts {
+		l := make([]byte, 2)
+		binary.BigEndian.PutUint16(l, uint16(len(sct)))
+		body = append(body, l...)
+		body = append(body, sct...)
+	}
+	out := make([]byte, 2)
+	binary.BigEndian.PutUint16(out, uint16(len(body)))
+	return append(out, body...)
+}
+
+func testSCT(logID byte, sig string) signedCertificateTimestamp {
+	var sct signedCertificateTimestamp
+	sct.version = 0
+	sct.logID[0] = logID
+	sct.timestamp = 1700000000000
+	sct.hashAlg = 4 // sha256
+	sct.sigAlg = 3  // ecdsa
+	sct.signature = []byte(sig)
+	return sct
+}
+
+func TestParseSCT(t *testing.T) {
+	want := testSCT(1, "deadbeef")
+	data := encodeSCT(want)
+
+	got, err := parseSCT(data)
+	if err != nil {
+		t.Fatalf("parseSCT: %v", err)
+	}
+	if got.version != want.version || got.logID != want.logID || got.timestamp != want.timestamp ||
+		got.hashAlg != want.hashAlg || got.sigAlg != want.sigAlg || !bytes.Equal(got.signature, want.signature) {
+		t.Fatalf("parseSCT round-trip mismatch: got %+v, want %+v", got, want)
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":                nil,
+		"too short":            {0x00},
+		"truncated extensions": append(encodeSCT(want)[:41], 0x00, 0xFF),
+		"truncated signature":  data[:len(data)-1],
+	} {
+		if _, err := parseSCT(data); err == nil {
+			t.Errorf("parseSCT(%s): expected error, got nil", name)
+		}
+	}
+}
+
+func TestParseSCTList(t *testing.T) {
+	a := encodeSCT(testSCT(1, "sig-a"))
+	b := encodeSCT(testSCT(2, "sig-b"))
+	list := encodeSCTList([][]byte{a, b})
+
+	scts, err := parseSCTList(list)
+	if err != nil {
+		t.Fatalf("parseSCTList: %v", err)
+	}
+	if len(scts) != 2 {
+		t.Fatalf("expected 2 scts, got %d", len(scts))
+	}
+	if !bytes.Equal(scts[0].signature, []byte("sig-a")) || !bytes.Equal(scts[1].signature, []byte("sig-b")) {
+		t.Fatalf("unexpected sct contents: %+v", scts)
+	}
+
+	if _, err := parseSCTList([]byte{0x00}); err == nil {
+		t.Error("parseSCTList: expected error for too-short input")
+	}
+	if _, err := parseSCTList([]byte{0x00, 0x05, 0x01, 0x02}); err == nil {
+		t.Error("parseSCTList: expected error for length mismatch")
+	}
+}
+
+func generateCertWithExtension(t *testing.T, extra []pkix.Extension) *x509.Certificate {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: "test"},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: extra,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return cert
+}
+
+func TestBuildPrecertTBS(t *testing.T) {
+	sctValue, err := asn1.Marshal([]byte{0x00, 0x01, 0x02})
+	if err != nil {
+		t.Fatalf("marshal sct extension value: %v", err)
+	}
+	cert := generateCertWithExtension(t, []pkix.Extension{
+		{Id: sctExtensionOID, Value: sctValue},
+	})
+
+	tbsBytes, err := buildPrecertTBS(cert)
+	if err != nil {
+		t.Fatalf("buildPrecertTBS: %v", err)
+	}
+
+	var tbs tbsCertificateForCT
+	if _, err := asn1.Unmarshal(tbsBytes, &tbs); err != nil {
+		t.Fatalf("reparse reconstructed tbs: %v", err)
+	}
+	if len(tbs.Extensions) != 1 || !tbs.Extensions[0].Id.Equal(poisonExtensionOID) {
+		t.Fatalf("expected the sct extension to be replaced by the poison extension, got %+v", tbs.Extensions)
+	}
+}
+
+func TestBuildPrecertTBSNoSCTExtension(t *testing.T) {
+	cert := generateCertWithExtension(t, nil)
+	if _, err := buildPrecertTBS(cert); err == nil {
+		t.Error("buildPrecertTBS: expected error for certificate without an sct extension")
+	}
+}
@@ -0,0 +1,312 @@
+package ca
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/metacubex/mihomo/common/lru"
+	log "github.com/metacubex/mihomo/log"
+)
+
+const (
+	// revocationFetchTimeout bounds OCSP/CRL fetches triggered from inside
+	// tls.Config.VerifyConnection, so an unreachable responder or CRL
+	// distribution point can't hang the handshake indefinitely.
+	revocationFetchTimeout = 10 * time.Second
+
+	// revocationCacheSize bounds the OCSP and CRL caches so a long-lived
+	// process that contacts many distinct sites/issuers doesn't grow these
+	// maps without bound; least-recently-used entries are evicted first.
+	revocationCacheSize = 4096
+)
+
+var revocationHTTPClient = &http.Client{Timeout: revocationFetchTimeout}
+
+// RevocationMode controls how a failed or inconclusive revocation check is
+// treated.
+type RevocationMode string
+
+const (
+	RevocationOff      RevocationMode = "off"
+	RevocationSoftFail RevocationMode = "soft-fail"
+	RevocationHardFail RevocationMode = "hard-fail"
+)
+
+// RevocationOptions is the per-proxy `revocation:` config block.
+type RevocationOptions struct {
+	Mode RevocationMode
+	OCSP bool
+	CRL  bool
+}
+
+func (opts RevocationOptions) enabled() bool {
+	return opts.Mode != "" && opts.Mode != RevocationOff && (opts.OCSP || opts.CRL)
+}
+
+// ocspCacheEntry additionally tracks, outside of the cache's own LRU
+// recency bookkeeping, the last time a real TLS handshake asked about this
+// cert - so the background refresher (scheduleOCSPRefresh) can tell "still
+// in the bounded cache" apart from "something out there still cares about
+// this cert" and stop polling once nobody does.
+type ocspCacheEntry struct {
+	response *ocsp.Response
+	lastUsed atomic.Int64 // unix seconds
+}
+
+var ocspCache = lru.New[string, *ocspCacheEntry](
+	lru.WithSize[string, *ocspCacheEntry](revocationCacheSize),
+	lru.WithAge[string, *ocspCacheEntry](1), // any >0 value turns on the per-entry expiry set via SetWithExpire
+)
+
+func ocspCacheKey(issuer *x509.Certificate, serial *big.Int) string {
+	return hex.EncodeToString(issuer.SubjectKeyId) + ":" + serial.String()
+}
+
+type crlCacheEntry struct {
+	revokedSerials map[string]struct{}
+}
+
+var crlCache = lru.New[string, *crlCacheEntry](
+	lru.WithSize[string, *crlCacheEntry](revocationCacheSize),
+	lru.WithAge[string, *crlCacheEntry](1),
+)
+
+// applyRevocationCheck layers OCSP/CRL revocation checking onto tlsConfig
+// according to opts, composing onto any VerifyConnection already set (e.g.
+// by applySCTCheck) rather than replacing it. It requires normal chain
+// verification to have produced a verified chain, so it's a no-op when the
+// config pins on fingerprint/SPKI alone (InsecureSkipVerify == true): there
+// is no trusted issuer to validate a revocation response against.
+func applyRevocationCheck(tlsConfig *tls.Config, opts RevocationOptions) *tls.Config {
+	if !opts.enabled() || tlsConfig.InsecureSkipVerify {
+		return tlsConfig
+	}
+
+	tlsConfig.VerifyConnection = chainVerifyConnection(tlsConfig.VerifyConnection, func(cs tls.ConnectionState) error {
+		if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) < 2 {
+			return nil
+		}
+		leaf := cs.VerifiedChains[0][0]
+		issuer := cs.VerifiedChains[0][1]
+
+		err := checkRevocation(leaf, issuer, cs.OCSPResponse, opts)
+		if err == nil {
+			return nil
+		}
+		if opts.Mode == RevocationHardFail {
+			return err
+		}
+		log.Warnln("revocation check inconclusive for %s, soft-failing: %v", leaf.Subject, err)
+		return nil
+	})
+	return tlsConfig
+}
+
+// checkRevocation returns nil only when a revocation source positively
+// confirms the certificate is Good; any error means "could not confirm",
+// which the caller treats according to opts.Mode.
+func checkRevocation(leaf, issuer *x509.Certificate, staple []byte, opts RevocationOptions) error {
+	if opts.OCSP {
+		if err := checkOCSP(leaf, issuer, staple); err == nil {
+			return nil
+		} else if opts.CRL {
+			log.Debugln("ocsp check failed for %s, falling back to crl: %v", leaf.Subject, err)
+		} else {
+			return err
+		}
+	}
+	if opts.CRL {
+		return checkCRL(leaf, issuer)
+	}
+	return fmt.Errorf("no revocation source available")
+}
+
+func checkOCSP(leaf, issuer *x509.Certificate, staple []byte) error {
+	var resp *ocsp.Response
+	var err error
+
+	if len(staple) > 0 {
+		resp, err = ocsp.ParseResponseForCert(staple, leaf, issuer)
+		if err != nil {
+			return fmt.Errorf("parse ocsp staple: %w", err)
+		}
+	} else {
+		resp, err = fetchOCSP(leaf, issuer)
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	if now.Before(resp.ThisUpdate) {
+		return fmt.Errorf("ocsp response not yet valid")
+	}
+	if !resp.NextUpdate.IsZero() && now.After(resp.NextUpdate) {
+		return fmt.Errorf("ocsp response expired")
+	}
+	if resp.Status != ocsp.Good {
+		return fmt.Errorf("ocsp status: %d", resp.Status)
+	}
+	return nil
+}
+
+func fetchOCSP(leaf, issuer *x509.Certificate) (*ocsp.Response, error) {
+	key := ocspCacheKey(issuer, leaf.SerialNumber)
+
+	if entry, ok := ocspCache.Get(key); ok {
+		entry.lastUsed.Store(time.Now().Unix())
+		return entry.response, nil
+	}
+
+	if len(leaf.OCSPServer) == 0 {
+		return nil, fmt.Errorf("certificate has no OCSP server")
+	}
+
+	reqBytes, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create ocsp request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), revocationFetchTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(reqBytes))
+	if err != nil {
+		return nil, fmt.Errorf("build ocsp request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/ocsp-request")
+
+	httpResp, err := revocationHTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("fetch ocsp response: %w", err)
+	}
+	defer httpResp.Body.Close()
+
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read ocsp response: %w", err)
+	}
+
+	resp, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("parse ocsp response: %w", err)
+	}
+
+	entry := &ocspCacheEntry{response: resp}
+	entry.lastUsed.Store(time.Now().Unix())
+	ocspCache.SetWithExpire(key, entry, resp.NextUpdate)
+
+	if !resp.NextUpdate.IsZero() {
+		scheduleOCSPRefresh(key, leaf, issuer, resp.NextUpdate)
+	}
+	return resp, nil
+}
+
+// scheduleOCSPRefresh keeps a cached OCSP response fresh by refetching it
+// shortly before NextUpdate, so a handshake that lands right at expiry
+// doesn't have to block on a fetch. It only reschedules itself as long as
+// the entry is both still in the bounded cache (not evicted under LRU
+// pressure from other sites) and has actually been asked about since it was
+// last refreshed - otherwise a cert checked exactly once would otherwise
+// keep this process polling its OCSP responder forever.
+func scheduleOCSPRefresh(key string, leaf, issuer *x509.Certificate, nextUpdate time.Time) {
+	// The cache entry itself expires at NextUpdate, so the refetch has to
+	// run ahead of it or the lookup below would always miss.
+	const refreshLead = time.Minute
+	delay := time.Until(nextUpdate) - refreshLead
+	if delay <= 0 {
+		return
+	}
+	refreshedAt := time.Now()
+	time.AfterFunc(delay, func() {
+		entry, ok := ocspCache.Get(key)
+		if !ok {
+			return
+		}
+		if time.Unix(entry.lastUsed.Load(), 0).Before(refreshedAt) {
+			log.Debugln("ocsp entry %s idle since last refresh, stopping background refresh", key)
+			ocspCache.Delete(key)
+			return
+		}
+		ocspCache.Delete(key)
+		if _, err := fetchOCSP(leaf, issuer); err != nil {
+			log.Debugln("background ocsp refresh failed: %v", err)
+		}
+	})
+}
+
+func checkCRL(leaf, issuer *x509.Certificate) error {
+	if len(leaf.CRLDistributionPoints) == 0 {
+		return fmt.Errorf("certificate has no CRL distribution points")
+	}
+	url := leaf.CRLDistributionPoints[0]
+
+	if entry, ok := crlCache.Get(url); ok {
+		if _, revoked := entry.revokedSerials[leaf.SerialNumber.String()]; revoked {
+			return fmt.Errorf("certificate serial %s is on the CRL", leaf.SerialNumber)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), revocationFetchTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("build crl request: %w", err)
+	}
+
+	httpResp, err := revocationHTTPClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("fetch crl: %w", err)
+	}
+	defer httpResp.Body.Close()
+
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return fmt.Errorf("read crl: %w", err)
+	}
+
+	certList, err := x509.ParseRevocationList(body)
+	if err != nil {
+		return fmt.Errorf("parse crl: %w", err)
+	}
+	if err := certList.CheckSignatureFrom(issuer); err != nil {
+		return fmt.Errorf("crl signature verification failed: %w", err)
+	}
+
+	revoked := make(map[string]struct{}, len(certList.RevokedCertificateEntries))
+	for _, rc := range certList.RevokedCertificateEntries {
+		revoked[rc.SerialNumber.String()] = struct{}{}
+	}
+
+	expiresAt := certList.NextUpdate
+	if expiresAt.IsZero() {
+		expiresAt = time.Now().Add(1 * time.Hour)
+	}
+	crlCache.SetWithExpire(url, &crlCacheEntry{revokedSerials: revoked}, expiresAt)
+
+	if _, isRevoked := revoked[leaf.SerialNumber.String()]; isRevoked {
+		return fmt.Errorf("certificate serial %s is on the CRL", leaf.SerialNumber)
+	}
+	return nil
+}
+
+// GetTLSConfigWithRevocation behaves like GetTLSConfig but additionally
+// layers OCSP/CRL revocation checking onto the returned config.
+func GetTLSConfigWithRevocation(tlsConfig *tls.Config, fingerprint string, customCA string, customCAString string, revocation RevocationOptions) (*tls.Config, error) {
+	tlsConfig, err := GetTLSConfig(tlsConfig, fingerprint, customCA, customCAString)
+	if err != nil {
+		return nil, err
+	}
+	return applyRevocationCheck(tlsConfig, revocation), nil
+}
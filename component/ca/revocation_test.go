@@ -0,0 +1,189 @@
+package ca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// generateTestIssuer builds a self-signed CA certificate suitable for
+// signing both OCSP responses and CRLs in the tests below.
+func generateTestIssuer(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate issuer key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test issuer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("create issuer certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse issuer certificate: %v", err)
+	}
+	return cert, priv
+}
+
+// generateTestLeaf builds a leaf certificate issued by issuer, with the
+// given CRL distribution point so checkCRL has somewhere to fetch from.
+func generateTestLeaf(t *testing.T, issuer *x509.Certificate, issuerKey *ecdsa.PrivateKey, serial int64, crlURL string) *x509.Certificate {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate leaf key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "test leaf"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		CRLDistributionPoints: []string{crlURL},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &priv.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatalf("create leaf certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse leaf certificate: %v", err)
+	}
+	return cert
+}
+
+func TestCheckOCSPStatus(t *testing.T) {
+	issuer, issuerKey := generateTestIssuer(t)
+	leaf := generateTestLeaf(t, issuer, issuerKey, 2, "http://unused.invalid/crl")
+
+	makeStaple := func(status int, thisUpdate, nextUpdate time.Time) []byte {
+		staple, err := ocsp.CreateResponse(issuer, issuer, ocsp.Response{
+			Status:       status,
+			SerialNumber: leaf.SerialNumber,
+			ThisUpdate:   thisUpdate,
+			NextUpdate:   nextUpdate,
+		}, issuerKey)
+		if err != nil {
+			t.Fatalf("create ocsp response: %v", err)
+		}
+		return staple
+	}
+
+	now := time.Now()
+
+	t.Run("good", func(t *testing.T) {
+		staple := makeStaple(ocsp.Good, now.Add(-time.Minute), now.Add(time.Hour))
+		if err := checkOCSP(leaf, issuer, staple); err != nil {
+			t.Fatalf("expected good status to pass, got: %v", err)
+		}
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		staple := makeStaple(ocsp.Revoked, now.Add(-time.Minute), now.Add(time.Hour))
+		if err := checkOCSP(leaf, issuer, staple); err == nil {
+			t.Fatal("expected revoked status to fail")
+		}
+	})
+
+	t.Run("not yet valid", func(t *testing.T) {
+		staple := makeStaple(ocsp.Good, now.Add(time.Hour), now.Add(2*time.Hour))
+		if err := checkOCSP(leaf, issuer, staple); err == nil {
+			t.Fatal("expected not-yet-valid response to fail")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		staple := makeStaple(ocsp.Good, now.Add(-2*time.Hour), now.Add(-time.Hour))
+		if err := checkOCSP(leaf, issuer, staple); err == nil {
+			t.Fatal("expected expired response to fail")
+		}
+	})
+}
+
+func serveCRL(t *testing.T, der []byte) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(der)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCheckCRL(t *testing.T) {
+	issuer, issuerKey := generateTestIssuer(t)
+
+	t.Run("not revoked", func(t *testing.T) {
+		der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:     big.NewInt(1),
+			ThisUpdate: time.Now().Add(-time.Minute),
+			NextUpdate: time.Now().Add(time.Hour),
+		}, issuer, issuerKey)
+		if err != nil {
+			t.Fatalf("create crl: %v", err)
+		}
+		server := serveCRL(t, der)
+		leaf := generateTestLeaf(t, issuer, issuerKey, 10, server.URL)
+
+		if err := checkCRL(leaf, issuer); err != nil {
+			t.Fatalf("expected crl check to pass, got: %v", err)
+		}
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:     big.NewInt(1),
+			ThisUpdate: time.Now().Add(-time.Minute),
+			NextUpdate: time.Now().Add(time.Hour),
+			RevokedCertificateEntries: []x509.RevocationListEntry{
+				{SerialNumber: big.NewInt(11), RevocationTime: time.Now()},
+			},
+		}, issuer, issuerKey)
+		if err != nil {
+			t.Fatalf("create crl: %v", err)
+		}
+		server := serveCRL(t, der)
+		leaf := generateTestLeaf(t, issuer, issuerKey, 11, server.URL)
+
+		if err := checkCRL(leaf, issuer); err == nil {
+			t.Fatal("expected revoked serial to fail the crl check")
+		}
+	})
+
+	t.Run("forged signature is rejected", func(t *testing.T) {
+		forger, forgerKey := generateTestIssuer(t)
+		der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:     big.NewInt(1),
+			ThisUpdate: time.Now().Add(-time.Minute),
+			NextUpdate: time.Now().Add(time.Hour),
+		}, forger, forgerKey)
+		if err != nil {
+			t.Fatalf("create crl: %v", err)
+		}
+		server := serveCRL(t, der)
+		leaf := generateTestLeaf(t, issuer, issuerKey, 12, server.URL)
+
+		// leaf's CRL distribution point serves a CRL signed by a different
+		// CA than leaf's actual issuer - checkCRL must not trust it.
+		if err := checkCRL(leaf, issuer); err == nil {
+			t.Fatal("expected crl signed by the wrong issuer to be rejected")
+		}
+	})
+}
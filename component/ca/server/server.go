@@ -0,0 +1,314 @@
+// Package server provisions a TLS identity for the external
+// controller/dashboard: a self-signed certificate by default, or a real
+// certificate obtained via ACME when configured.
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	log "github.com/metacubex/mihomo/log"
+
+	C "github.com/metacubex/mihomo/constant"
+)
+
+const (
+	selfSignedValidity = 90 * 24 * time.Hour
+	renewBefore        = 7 * 24 * time.Hour
+	rotateCheckEvery   = 1 * time.Hour
+)
+
+// ACMEOptions is the `external-controller-tls.acme` config block.
+type ACMEOptions struct {
+	Domain string
+	Email  string
+}
+
+// Options is the `external-controller-tls` config block.
+type Options struct {
+	// Host is the configured external-controller host (without port), added
+	// as a SAN of the self-signed certificate.
+	Host string
+	ACME *ACMEOptions
+}
+
+func tlsDir() string {
+	return C.Path.Resolve("controller-tls")
+}
+
+// GetControllerTLSConfig returns a *tls.Config for the external controller
+// listener: ACME-issued when opts.ACME names a domain, otherwise a
+// self-signed identity that's generated on first use and rotated in the
+// background before it expires.
+func GetControllerTLSConfig(opts Options) (*tls.Config, error) {
+	dir := tlsDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create controller-tls dir: %w", err)
+	}
+
+	if opts.ACME != nil && opts.ACME.Domain != "" {
+		return acmeTLSConfig(dir, opts.ACME)
+	}
+	return selfSignedTLSConfig(dir, opts.Host)
+}
+
+func acmeTLSConfig(dir string, opts *ACMEOptions) (*tls.Config, error) {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(dir),
+		HostPolicy: autocert.HostWhitelist(opts.Domain),
+		Email:      opts.Email,
+	}
+	// autocert.Manager renews on demand as certificates approach expiry, so
+	// no separate rotation goroutine is needed for the ACME path.
+	startHTTP01Challenge(manager)
+	return manager.TLSConfig(), nil
+}
+
+var (
+	acmeHTTPMu     sync.Mutex
+	acmeHTTPServer *http.Server
+)
+
+// startHTTP01Challenge binds :80 and serves ACME HTTP-01 challenge responses
+// so the CA doesn't have to fall back to TLS-ALPN-01, which only works when
+// it can reach us directly on 443. Like selfSignedTLSConfig's rotation loop,
+// a config reload (e.g. a changed ACME domain, or just re-invoking
+// GetControllerTLSConfig) must close out the previous listener first -
+// otherwise it leaks its goroutine forever and the new call's
+// ListenAndServe just fails silently into the "unavailable" warning below
+// because :80 is still held by the old one.
+func startHTTP01Challenge(manager *autocert.Manager) {
+	server := &http.Server{
+		Addr:    ":80",
+		Handler: manager.HTTPHandler(nil),
+	}
+
+	acmeHTTPMu.Lock()
+	previous := acmeHTTPServer
+	acmeHTTPServer = server
+	acmeHTTPMu.Unlock()
+	if previous != nil {
+		_ = previous.Close()
+	}
+
+	// Best-effort: if :80 is unavailable (not running as root, already bound
+	// by something else), we log and keep going - the manager still
+	// completes TLS-ALPN-01 challenges via the *tls.Config returned from
+	// acmeTLSConfig.
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Warnln("acme http-01 challenge listener unavailable, falling back to tls-alpn-01: %v", err)
+		}
+	}()
+}
+
+var (
+	selfSignedMu   sync.RWMutex
+	selfSignedCert *tls.Certificate
+	selfSignedHost string
+	selfSignedStop chan struct{}
+)
+
+// selfSignedTLSConfig returns the shared self-signed identity for host,
+// (re)generating it and restarting the rotation loop only when host changes
+// or no rotation loop is running yet - repeated calls (e.g. a config
+// hot-reload of the external-controller block) must not pile up another
+// rotateSelfSignedLoop goroutine on top of the existing one.
+func selfSignedTLSConfig(dir, host string) (*tls.Config, error) {
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+
+	selfSignedMu.RLock()
+	reuse := selfSignedCert != nil && selfSignedStop != nil && selfSignedHost == host
+	selfSignedMu.RUnlock()
+	if reuse {
+		return selfSignedTLSConfigHandle(), nil
+	}
+
+	cert, err := loadOrGenerateSelfSigned(certPath, keyPath, host)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	selfSignedMu.Lock()
+	previousStop := selfSignedStop
+	selfSignedCert = cert
+	selfSignedHost = host
+	selfSignedStop = stop
+	selfSignedMu.Unlock()
+	if previousStop != nil {
+		close(previousStop)
+	}
+
+	logFingerprint(cert)
+	go rotateSelfSignedLoop(certPath, keyPath, host, stop)
+
+	return selfSignedTLSConfigHandle(), nil
+}
+
+func selfSignedTLSConfigHandle() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			selfSignedMu.RLock()
+			defer selfSignedMu.RUnlock()
+			return selfSignedCert, nil
+		},
+	}
+}
+
+func loadOrGenerateSelfSigned(certPath, keyPath, host string) (*tls.Certificate, error) {
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+			if time.Now().Before(leaf.NotAfter.Add(-renewBefore)) && selfSignedCoversHost(leaf, host) {
+				cert.Leaf = leaf
+				return &cert, nil
+			}
+		}
+	}
+	return generateSelfSigned(certPath, keyPath, host)
+}
+
+// selfSignedCoversHost reports whether leaf's SANs already cover host, so
+// changing external-controller-tls's host regenerates the certificate
+// immediately instead of waiting for the old one to expire.
+func selfSignedCoversHost(leaf *x509.Certificate, host string) bool {
+	host = strings.TrimSpace(host)
+	if host == "" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, certIP := range leaf.IPAddresses {
+			if certIP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, name := range leaf.DNSNames {
+		if name == host {
+			return true
+		}
+	}
+	return false
+}
+
+func generateSelfSigned(certPath, keyPath, host string) (*tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate controller key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generate serial number: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "mihomo external controller"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+
+	host = strings.TrimSpace(host)
+	if host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, fmt.Errorf("create self-signed certificate: %w", err)
+	}
+
+	keyBytes, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("marshal controller key: %w", err)
+	}
+
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return nil, fmt.Errorf("write controller cert: %w", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0o600); err != nil {
+		return nil, fmt.Errorf("write controller key: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("parse generated certificate: %w", err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}, nil
+}
+
+// rotateSelfSignedLoop runs until stop is closed, which happens as soon as
+// another selfSignedTLSConfig call supersedes this identity (e.g. the
+// external-controller host changed), so replacing the identity never leaks
+// the previous loop's goroutine or ticker.
+func rotateSelfSignedLoop(certPath, keyPath, host string, stop <-chan struct{}) {
+	ticker := time.NewTicker(rotateCheckEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		selfSignedMu.RLock()
+		leaf := selfSignedCert.Leaf
+		selfSignedMu.RUnlock()
+
+		if leaf != nil && time.Now().Before(leaf.NotAfter.Add(-renewBefore)) {
+			continue
+		}
+
+		cert, err := generateSelfSigned(certPath, keyPath, host)
+		if err != nil {
+			log.Warnln("failed to rotate controller certificate: %v", err)
+			continue
+		}
+
+		selfSignedMu.Lock()
+		selfSignedCert = cert
+		selfSignedMu.Unlock()
+
+		logFingerprint(cert)
+	}
+}
+
+func logFingerprint(cert *tls.Certificate) {
+	hash := sha256.Sum256(cert.Certificate[0])
+	log.Infoln("external controller TLS fingerprint: %s", hex.EncodeToString(hash[:]))
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"crypto/x509"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestGenerateSelfSignedCoversHostAndLoopback(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+
+	cert, err := generateSelfSigned(certPath, keyPath, "controller.example")
+	if err != nil {
+		t.Fatalf("generateSelfSigned: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse generated certificate: %v", err)
+	}
+
+	if !selfSignedCoversHost(leaf, "controller.example") {
+		t.Error("expected generated certificate to cover the configured host")
+	}
+	if !selfSignedCoversHost(leaf, "127.0.0.1") || !selfSignedCoversHost(leaf, "::1") {
+		t.Error("expected generated certificate to always cover loopback addresses")
+	}
+	if selfSignedCoversHost(leaf, "other.example") {
+		t.Error("expected generated certificate not to cover an unrelated host")
+	}
+
+	for _, f := range []string{certPath, keyPath} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("expected %s to be written: %v", f, err)
+		}
+	}
+}
+
+func TestLoadOrGenerateSelfSignedReusesValidCert(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+
+	first, err := loadOrGenerateSelfSigned(certPath, keyPath, "controller.example")
+	if err != nil {
+		t.Fatalf("loadOrGenerateSelfSigned (first): %v", err)
+	}
+
+	second, err := loadOrGenerateSelfSigned(certPath, keyPath, "controller.example")
+	if err != nil {
+		t.Fatalf("loadOrGenerateSelfSigned (second): %v", err)
+	}
+
+	if string(second.Certificate[0]) != string(first.Certificate[0]) {
+		t.Error("expected an unexpired certificate covering the same host to be reused, not regenerated")
+	}
+}
+
+func TestLoadOrGenerateSelfSignedRegeneratesOnHostChange(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+
+	first, err := loadOrGenerateSelfSigned(certPath, keyPath, "controller.example")
+	if err != nil {
+		t.Fatalf("loadOrGenerateSelfSigned (first): %v", err)
+	}
+
+	second, err := loadOrGenerateSelfSigned(certPath, keyPath, "changed.example")
+	if err != nil {
+		t.Fatalf("loadOrGenerateSelfSigned (second): %v", err)
+	}
+
+	if string(second.Certificate[0]) == string(first.Certificate[0]) {
+		t.Error("expected a changed host to force regeneration instead of reusing the old SANs")
+	}
+}
+
+func TestSelfSignedTLSConfigDoesNotLeakRotationLoopOnHostChange(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := selfSignedTLSConfig(dir, "first.example"); err != nil {
+		t.Fatalf("selfSignedTLSConfig (first): %v", err)
+	}
+	selfSignedMu.RLock()
+	firstStop := selfSignedStop
+	selfSignedMu.RUnlock()
+
+	if _, err := selfSignedTLSConfig(dir, "second.example"); err != nil {
+		t.Fatalf("selfSignedTLSConfig (second): %v", err)
+	}
+	selfSignedMu.RLock()
+	secondStop := selfSignedStop
+	selfSignedMu.RUnlock()
+
+	if firstStop == secondStop {
+		t.Fatal("expected a changed host to start a fresh rotation loop")
+	}
+	select {
+	case <-firstStop:
+	case <-time.After(time.Second):
+		t.Error("expected the superseded rotation loop's stop channel to be closed")
+	}
+}
+
+func TestStartHTTP01ChallengeClosesPreviousListener(t *testing.T) {
+	manager := &autocert.Manager{Prompt: autocert.AcceptTOS}
+
+	startHTTP01Challenge(manager)
+	acmeHTTPMu.Lock()
+	first := acmeHTTPServer
+	acmeHTTPMu.Unlock()
+	if first == nil {
+		t.Fatal("expected a server to be recorded after starting the http-01 challenge listener")
+	}
+
+	startHTTP01Challenge(manager)
+	acmeHTTPMu.Lock()
+	second := acmeHTTPServer
+	acmeHTTPMu.Unlock()
+	t.Cleanup(func() {
+		acmeHTTPMu.Lock()
+		s := acmeHTTPServer
+		acmeHTTPMu.Unlock()
+		if s != nil {
+			_ = s.Close()
+		}
+	})
+
+	if second == first {
+		t.Fatal("expected a fresh server instance on the second call")
+	}
+	if err := first.ListenAndServe(); err != http.ErrServerClosed {
+		t.Fatalf("expected the superseded listener to already be closed, got: %v", err)
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,9 +16,10 @@ import (
 )
 
 var globalFingerprints = make([][32]byte, 0)
+var globalSPKIPins = make([][32]byte, 0)
 var mutex sync.Mutex
 
-func verifyPeerCertificateAndFingerprints(fingerprints *[][32]byte, insecureSkipVerify bool) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+func verifyPeerCertificateAndFingerprints(fingerprints *[][32]byte, spkiPins *[][32]byte, insecureSkipVerify bool) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 		if insecureSkipVerify {
 			return nil
@@ -41,6 +44,13 @@ func verifyPeerCertificateAndFingerprints(fingerprints *[][32]byte, insecureSkip
 						}
 					}
 
+					spkiHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					for _, pin := range *spkiPins {
+						if bytes.Equal(spkiHash[:], pin[:]) {
+							return nil
+						}
+					}
+
 					preErr = err
 				}
 			}
@@ -62,6 +72,21 @@ func AddCertFingerprint(fingerprint string) error {
 	return nil
 }
 
+// AddSPKIPin adds a pin of the SHA-256 hash of a certificate's DER-encoded
+// SubjectPublicKeyInfo, as used by HPKP/RFC 7469. pin may be raw hex, raw
+// base64, or the `pin-sha256="base64=="` form produced by browser devtools.
+func AddSPKIPin(pin string) error {
+	pinByte, err := convertSPKIPin(pin)
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	globalSPKIPins = append(globalSPKIPins, *pinByte)
+	mutex.Unlock()
+	return nil
+}
+
 func convertFingerprint(fingerprint string) (*[32]byte, error) {
 	fpByte, err := hex.DecodeString(fingerprint)
 	if err != nil {
@@ -74,6 +99,30 @@ func convertFingerprint(fingerprint string) (*[32]byte, error) {
 	return (*[32]byte)(fpByte), nil
 }
 
+// convertSPKIPin accepts the `pin-sha256="..."` form as well as bare
+// base64/hex encodings of a SHA-256 SPKI hash.
+func convertSPKIPin(pin string) (*[32]byte, error) {
+	pin = strings.TrimSpace(pin)
+	if strings.HasPrefix(pin, "pin-sha256=") {
+		pin = strings.TrimPrefix(pin, "pin-sha256=")
+		pin = strings.Trim(pin, `"`)
+	}
+
+	if pinByte, err := base64.StdEncoding.DecodeString(pin); err == nil && len(pinByte) == 32 {
+		return (*[32]byte)(pinByte), nil
+	}
+
+	pinByte, err := hex.DecodeString(pin)
+	if err != nil {
+		return nil, fmt.Errorf("spki pin is neither valid base64 nor hex: %w", err)
+	}
+
+	if len(pinByte) != 32 {
+		return nil, fmt.Errorf("spki pin length error,need sha256 spki pin")
+	}
+	return (*[32]byte)(pinByte), nil
+}
+
 func GetDefaultTLSConfig() *tls.Config {
 	return GetGlobalFingerprintTLSConfig(nil)
 }
@@ -86,10 +135,30 @@ func GetSpecifiedFingerprintTLSConfig(tlsConfig *tls.Config, fingerprint string)
 		if tlsConfig == nil {
 			return &tls.Config{
 				InsecureSkipVerify:    true,
-				VerifyPeerCertificate: verifyPeerCertificateAndFingerprints(&[][32]byte{*fingerprintBytes}, false),
+				VerifyPeerCertificate: verifyPeerCertificateAndFingerprints(&[][32]byte{*fingerprintBytes}, &[][32]byte{}, false),
+			}, nil
+		} else {
+			tlsConfig.VerifyPeerCertificate = verifyPeerCertificateAndFingerprints(&[][32]byte{*fingerprintBytes}, &[][32]byte{}, tlsConfig.InsecureSkipVerify)
+			tlsConfig.InsecureSkipVerify = true
+			return tlsConfig, nil
+		}
+	}
+}
+
+// GetSpecifiedSPKIPinTLSConfig pins on the SHA-256 hash of the peer's
+// SubjectPublicKeyInfo instead of the whole certificate, so rotating a leaf
+// cert while keeping the same key pair doesn't break the pin.
+func GetSpecifiedSPKIPinTLSConfig(tlsConfig *tls.Config, pin string) (*tls.Config, error) {
+	if pinBytes, err := convertSPKIPin(pin); err != nil {
+		return nil, err
+	} else {
+		if tlsConfig == nil {
+			return &tls.Config{
+				InsecureSkipVerify:    true,
+				VerifyPeerCertificate: verifyPeerCertificateAndFingerprints(&[][32]byte{}, &[][32]byte{*pinBytes}, false),
 			}, nil
 		} else {
-			tlsConfig.VerifyPeerCertificate = verifyPeerCertificateAndFingerprints(&[][32]byte{*fingerprintBytes}, tlsConfig.InsecureSkipVerify)
+			tlsConfig.VerifyPeerCertificate = verifyPeerCertificateAndFingerprints(&[][32]byte{}, &[][32]byte{*pinBytes}, tlsConfig.InsecureSkipVerify)
 			tlsConfig.InsecureSkipVerify = true
 			return tlsConfig, nil
 		}
@@ -100,15 +169,15 @@ func GetGlobalFingerprintTLSConfig(tlsConfig *tls.Config) *tls.Config {
 	// If there's more than one fingerprints then we could skip the general check
 	// If there's no fingerprints but the config insists then we should skip.
 	// Otherwise we should do a general verification.
-	shouldSkipVerify := len(globalFingerprints) != 0 || tlsConfig != nil && tlsConfig.InsecureSkipVerify
+	shouldSkipVerify := len(globalFingerprints) != 0 || len(globalSPKIPins) != 0 || tlsConfig != nil && tlsConfig.InsecureSkipVerify
 	if tlsConfig == nil {
 		return &tls.Config{
 			InsecureSkipVerify:    shouldSkipVerify,
-			VerifyPeerCertificate: verifyPeerCertificateAndFingerprints(&globalFingerprints, false),
+			VerifyPeerCertificate: verifyPeerCertificateAndFingerprints(&globalFingerprints, &globalSPKIPins, false),
 		}
 	}
 
-	tlsConfig.VerifyPeerCertificate = verifyPeerCertificateAndFingerprints(&globalFingerprints, tlsConfig.InsecureSkipVerify)
+	tlsConfig.VerifyPeerCertificate = verifyPeerCertificateAndFingerprints(&globalFingerprints, &globalSPKIPins, tlsConfig.InsecureSkipVerify)
 	tlsConfig.InsecureSkipVerify = shouldSkipVerify
 	return tlsConfig
 }
@@ -121,10 +190,10 @@ func GetSpecifiedFingerprintXTLSConfig(tlsConfig *xtls.Config, fingerprint strin
 		if tlsConfig == nil {
 			return &xtls.Config{
 				InsecureSkipVerify:    true,
-				VerifyPeerCertificate: verifyPeerCertificateAndFingerprints(&[][32]byte{*fingerprintBytes}, false),
+				VerifyPeerCertificate: verifyPeerCertificateAndFingerprints(&[][32]byte{*fingerprintBytes}, &[][32]byte{}, false),
 			}, nil
 		} else {
-			tlsConfig.VerifyPeerCertificate = verifyPeerCertificateAndFingerprints(&[][32]byte{*fingerprintBytes}, tlsConfig.InsecureSkipVerify)
+			tlsConfig.VerifyPeerCertificate = verifyPeerCertificateAndFingerprints(&[][32]byte{*fingerprintBytes}, &[][32]byte{}, tlsConfig.InsecureSkipVerify)
 			tlsConfig.InsecureSkipVerify = true
 			return tlsConfig, nil
 		}
@@ -132,15 +201,15 @@ func GetSpecifiedFingerprintXTLSConfig(tlsConfig *xtls.Config, fingerprint strin
 }
 
 func GetGlobalFingerprintXTLSConfig(tlsConfig *xtls.Config) *xtls.Config {
-	shouldSkipVerify := len(globalFingerprints) != 0 || tlsConfig != nil && tlsConfig.InsecureSkipVerify
+	shouldSkipVerify := len(globalFingerprints) != 0 || len(globalSPKIPins) != 0 || tlsConfig != nil && tlsConfig.InsecureSkipVerify
 	if tlsConfig == nil {
 		return &xtls.Config{
 			InsecureSkipVerify:    shouldSkipVerify,
-			VerifyPeerCertificate: verifyPeerCertificateAndFingerprints(&globalFingerprints, false),
+			VerifyPeerCertificate: verifyPeerCertificateAndFingerprints(&globalFingerprints, &globalSPKIPins, false),
 		}
 	}
 
-	tlsConfig.VerifyPeerCertificate = verifyPeerCertificateAndFingerprints(&globalFingerprints, tlsConfig.InsecureSkipVerify)
+	tlsConfig.VerifyPeerCertificate = verifyPeerCertificateAndFingerprints(&globalFingerprints, &globalSPKIPins, tlsConfig.InsecureSkipVerify)
 	tlsConfig.InsecureSkipVerify = shouldSkipVerify
 	return tlsConfig
 }
@@ -2,14 +2,21 @@ package config
 
 import (
 	"archive/zip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	C "github.com/Dreamacro/clash/constant"
 )
@@ -17,117 +24,337 @@ import (
 const (
 	xdURL   = "https://codeload.github.com/MetaCubeX/metacubexd/zip/refs/heads/gh-pages"
 	yacdURL = "https://codeload.github.com/MetaCubeX/Yacd-meta/zip/refs/heads/gh-pages"
+
+	xdManifestURL   = "https://raw.githubusercontent.com/MetaCubeX/metacubexd/gh-pages/manifest.json"
+	yacdManifestURL = "https://raw.githubusercontent.com/MetaCubeX/Yacd-meta/gh-pages/manifest.json"
+
+	maxUIEntrySize = 20 * 1024 * 1024  // reject any single extracted file over 20MiB
+	maxUITotalSize = 200 * 1024 * 1024 // reject a bundle whose total decompressed size exceeds this
 )
 
-var xdMutex sync.Mutex
+// uiUpdateKeyB64 is the embedded maintainer Ed25519 public key used to
+// authenticate UI bundle manifests. Swapped for the real release key at
+// build time; DISABLE_UI_SIGNATURE_CHECK lets air-gapped rebuilds opt out.
+const uiUpdateKeyB64 = "Q760zvU21mg6xqTjIVRlSnpGwOB9P69tJRIBRr8jH8k="
 
-func UpdateUI(ui string) error {
-	xdMutex.Lock()
-	defer xdMutex.Unlock()
+var DisableUISignatureCheck, _ = strconv.ParseBool(os.Getenv("DISABLE_UI_SIGNATURE_CHECK"))
+
+var (
+	uiMutex       sync.Mutex
+	uiUpdateKeys  []ed25519.PublicKey
+	uiUpdateKeysM sync.RWMutex
+)
+
+func init() {
+	key, err := base64.StdEncoding.DecodeString(uiUpdateKeyB64)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return
+	}
+	uiUpdateKeys = append(uiUpdateKeys, ed25519.PublicKey(key))
+}
 
-	var url string
+// AddUIUpdateKey registers an additional trusted Ed25519 public key (base64)
+// that a UI bundle manifest's signature may be verified against.
+func AddUIUpdateKey(pubKey string) error {
+	key, err := base64.StdEncoding.DecodeString(pubKey)
+	if err != nil {
+		return fmt.Errorf("decode ui update key: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("ui update key must be %d bytes", ed25519.PublicKeySize)
+	}
+
+	uiUpdateKeysM.Lock()
+	defer uiUpdateKeysM.Unlock()
+	uiUpdateKeys = append(uiUpdateKeys, ed25519.PublicKey(key))
+	return nil
+}
+
+// uiManifest is published alongside each UI bundle zip and authenticates it.
+type uiManifest struct {
+	Version   string `json:"version"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"` // base64 Ed25519 signature over sha256||version
+}
 
+func uiURLs(ui string) (zipURL, manifestURL string) {
 	if ui == "xd" {
-		url = xdURL
-	} else {
-		url = yacdURL
+		return xdURL, xdManifestURL
+	}
+	return yacdURL, yacdManifestURL
+}
+
+func fetchUIManifest(manifestURL string) (*uiManifest, error) {
+	data, _, _, err := downloadWithETag(manifestURL, "")
+	if err != nil {
+		return nil, fmt.Errorf("can't download manifest: %w", err)
+	}
+
+	var manifest uiManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("can't parse manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+func verifyUIManifest(manifest *uiManifest, zipData []byte) error {
+	sum := sha256.Sum256(zipData)
+	if hex.EncodeToString(sum[:]) != manifest.SHA256 {
+		return fmt.Errorf("zip sha256 mismatch")
+	}
+
+	if DisableUISignatureCheck {
+		return nil
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(manifest.Signature)
+	if err != nil {
+		return fmt.Errorf("decode manifest signature: %w", err)
+	}
+
+	message := append(append([]byte{}, sum[:]...), []byte(manifest.Version)...)
+
+	uiUpdateKeysM.RLock()
+	defer uiUpdateKeysM.RUnlock()
+	for _, key := range uiUpdateKeys {
+		if ed25519.Verify(key, message, sig) {
+			return nil
+		}
+	}
+	return fmt.Errorf("manifest signature does not match any trusted key")
+}
+
+func versionFilePath(ui string) string {
+	return path.Join(C.UIPath, fmt.Sprintf(".%s.version", ui))
+}
+
+func currentUIVersion(ui string) string {
+	data, err := os.ReadFile(versionFilePath(ui))
+	if err != nil {
+		return ""
 	}
+	return strings.TrimSpace(string(data))
+}
 
-	err := cleanup(path.Join(C.UIPath, ui))
+// CheckUIUpdate reports the installed and latest available versions of ui
+// without downloading the bundle itself.
+func CheckUIUpdate(ui string) (currentVersion string, latestVersion string, needsUpdate bool, err error) {
+	_, manifestURL := uiURLs(ui)
+	manifest, err := fetchUIManifest(manifestURL)
 	if err != nil {
-		return fmt.Errorf("cleanup exist file error: %w", err)
+		return "", "", false, err
 	}
 
-	data, err := downloadForBytes(url)
+	currentVersion = currentUIVersion(ui)
+	return currentVersion, manifest.Version, currentVersion != manifest.Version, nil
+}
+
+// UpdateUI downloads, verifies and atomically installs the ui bundle
+// ("xd" or "yacd"). A partial or corrupt download never replaces a working
+// installation: the new bundle is extracted and verified in a staging
+// directory and only swapped in once fully validated.
+func UpdateUI(ui string) error {
+	uiMutex.Lock()
+	defer uiMutex.Unlock()
+
+	zipURL, manifestURL := uiURLs(ui)
+
+	manifest, err := fetchUIManifest(manifestURL)
 	if err != nil {
-		return fmt.Errorf("can't download  file: %w", err)
+		return err
 	}
 
-	saved := path.Join(C.UIPath, "download.zip")
-	if saveFile(data, saved) != nil {
+	if manifest.Version != "" && manifest.Version == currentUIVersion(ui) {
+		return nil
+	}
+
+	etagPath := path.Join(C.UIPath, fmt.Sprintf(".%s.etag", ui))
+	prevEtag, _ := os.ReadFile(etagPath)
+
+	zipData, etag, notModified, err := downloadWithETag(zipURL, strings.TrimSpace(string(prevEtag)))
+	if err != nil {
+		return fmt.Errorf("can't download file: %w", err)
+	}
+	if notModified {
+		return nil
+	}
+
+	if err := verifyUIManifest(manifest, zipData); err != nil {
+		return fmt.Errorf("ui bundle failed verification: %w", err)
+	}
+
+	staging := path.Join(C.UIPath, fmt.Sprintf(".staging-%d", time.Now().UnixNano()))
+	if err := os.MkdirAll(staging, os.ModePerm); err != nil {
+		return fmt.Errorf("can't create staging dir: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	zipPath := path.Join(staging, "download.zip")
+	if err := os.WriteFile(zipPath, zipData, 0o644); err != nil {
 		return fmt.Errorf("can't save zip file: %w", err)
 	}
-	defer os.Remove(saved)
 
-	unzipFolder, err := unzip(saved, C.UIPath)
+	extractedRoot, err := unzip(zipPath, path.Join(staging, "extracted"))
 	if err != nil {
 		return fmt.Errorf("can't extract zip file: %w", err)
 	}
 
-	files, err := ioutil.ReadDir(unzipFolder)
-	if err != nil {
-		return fmt.Errorf("Error reading source folder: %w", err)
+	target := path.Join(C.UIPath, ui)
+	backup := path.Join(C.UIPath, fmt.Sprintf(".%s.bak-%d", ui, time.Now().UnixNano()))
+
+	hadPrevious := false
+	if _, err := os.Stat(target); err == nil {
+		if err := os.Rename(target, backup); err != nil {
+			return fmt.Errorf("can't move aside previous ui: %w", err)
+		}
+		hadPrevious = true
 	}
 
-	for _, file := range files {
-		err = os.Rename(filepath.Join(unzipFolder, file.Name()), filepath.Join(C.UIPath, file.Name()))
-		if err != nil {
-			return nil
+	if err := os.Rename(extractedRoot, target); err != nil {
+		if hadPrevious {
+			_ = os.Rename(backup, target)
 		}
+		return fmt.Errorf("can't install new ui: %w", err)
+	}
+
+	if hadPrevious {
+		os.RemoveAll(backup)
+	}
+
+	if err := os.WriteFile(versionFilePath(ui), []byte(manifest.Version), 0o644); err != nil {
+		return fmt.Errorf("can't persist ui version: %w", err)
+	}
+	if etag != "" {
+		_ = os.WriteFile(etagPath, []byte(etag), 0o644)
 	}
-	defer os.Remove(path.Join(C.UIPath, ui)
+	return nil
 }
 
+// downloadWithETag GETs url, sending If-None-Match: prevEtag when set.
+// notModified is true on a 304 response, in which case data/etag are empty.
+func downloadWithETag(url string, prevEtag string) (data []byte, etag string, notModified bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if prevEtag != "" {
+		req.Header.Set("If-None-Match", prevEtag)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, "", true, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", false, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxUITotalSize))
+	if err != nil {
+		return nil, "", false, err
+	}
+	return body, resp.Header.Get("ETag"), false, nil
+}
+
+// unzip extracts src into a freshly created dest and returns the path of its
+// single top-level entry. Entries that would escape dest, symlinks, and
+// payloads over the configured size limits are rejected outright.
 func unzip(src, dest string) (string, error) {
 	r, err := zip.OpenReader(src)
 	if err != nil {
 		return "", err
 	}
 	defer r.Close()
-	var extractedFolder string
+
+	if err := os.MkdirAll(dest, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	var totalSize int64
+	var topLevel string
 	for _, f := range r.File {
+		if f.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to extract symlink: %s", f.Name)
+		}
+
 		fpath := filepath.Join(dest, f.Name)
 		if !strings.HasPrefix(fpath, filepath.Clean(dest)+string(os.PathSeparator)) {
-			return "", fmt.Errorf("invalid file path: %s", fpath)
+			return "", fmt.Errorf("invalid file path: %s", f.Name)
 		}
+
+		if name := topLevelEntry(f.Name); name != "" && topLevel == "" {
+			topLevel = name
+		}
+
 		if f.FileInfo().IsDir() {
-			os.MkdirAll(fpath, os.ModePerm)
+			if err := os.MkdirAll(fpath, os.ModePerm); err != nil {
+				return "", err
+			}
 			continue
 		}
-		if err = os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
-			return "", err
-		}
-		outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-		if err != nil {
-			return "", err
+
+		if f.UncompressedSize64 > maxUIEntrySize {
+			return "", fmt.Errorf("entry %s exceeds the %d byte limit", f.Name, maxUIEntrySize)
 		}
-		rc, err := f.Open()
-		if err != nil {
+
+		if err := os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
 			return "", err
 		}
-		_, err = io.Copy(outFile, rc)
-		outFile.Close()
-		rc.Close()
+		written, err := extractZipEntry(f, fpath)
 		if err != nil {
 			return "", err
 		}
-		if extractedFolder == "" {
-			extractedFolder = filepath.Dir(fpath)
+
+		// Trust what was actually written, not the zip header's (attacker
+		// controlled) UncompressedSize64, which a crafted entry can
+		// under-report while still decompressing up to the per-entry cap.
+		totalSize += written
+		if totalSize > maxUITotalSize {
+			return "", fmt.Errorf("bundle exceeds the %d byte decompressed size limit", maxUITotalSize)
 		}
 	}
-	return extractedFolder, nil
+
+	if topLevel == "" {
+		return "", fmt.Errorf("zip has no top-level directory")
+	}
+	return filepath.Join(dest, topLevel), nil
 }
 
-func cleanup(root string) error {
-	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
-		}
-		if info.IsDir() {
-			if err := os.RemoveAll(path); err != nil {
-				if os.IsNotExist(err) {
-					return nil
-				}
-				return err
-			}
-		} else {
-			if err := os.Remove(path); err != nil {
-				if os.IsNotExist(err) {
-					return nil
-				}
-				return err
-			}
-		}
-		return nil
-	})
+// extractZipEntry writes f's decompressed contents to fpath and returns the
+// number of bytes actually written. It errors out rather than silently
+// truncating an entry that decompresses past maxUIEntrySize.
+func extractZipEntry(f *zip.File, fpath string) (int64, error) {
+	outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+	if err != nil {
+		return 0, err
+	}
+	defer outFile.Close()
+
+	rc, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	written, err := io.Copy(outFile, io.LimitReader(rc, maxUIEntrySize+1))
+	if err != nil {
+		return written, err
+	}
+	if written > maxUIEntrySize {
+		return written, fmt.Errorf("entry %s exceeds the %d byte limit", f.Name, maxUIEntrySize)
+	}
+	return written, nil
+}
+
+func topLevelEntry(name string) string {
+	name = strings.TrimPrefix(path.Clean(name), "/")
+	if idx := strings.Index(name, "/"); idx >= 0 {
+		return name[:idx]
+	}
+	return name
 }
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func buildZip(t *testing.T, files map[string][]byte, symlinks map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	zipPath := filepath.Join(dir, "bundle.zip")
+
+	f, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatalf("create zip file: %v", err)
+	}
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	for name, content := range files {
+		entry, err := w.Create(name)
+		if err != nil {
+			t.Fatalf("create entry %s: %v", name, err)
+		}
+		if _, err := entry.Write(content); err != nil {
+			t.Fatalf("write entry %s: %v", name, err)
+		}
+	}
+	for name, target := range symlinks {
+		hdr := &zip.FileHeader{Name: name}
+		hdr.SetMode(os.ModeSymlink)
+		entry, err := w.CreateHeader(hdr)
+		if err != nil {
+			t.Fatalf("create symlink header %s: %v", name, err)
+		}
+		if _, err := entry.Write([]byte(target)); err != nil {
+			t.Fatalf("write symlink target %s: %v", name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close zip writer: %v", err)
+	}
+	return zipPath
+}
+
+func TestUnzipExtractsTopLevelDir(t *testing.T) {
+	zipPath := buildZip(t, map[string][]byte{
+		"bundle/index.html": []byte("<html></html>"),
+		"bundle/assets/a.js": []byte("console.log(1)"),
+	}, nil)
+
+	root, err := unzip(zipPath, filepath.Join(filepath.Dir(zipPath), "extracted"))
+	if err != nil {
+		t.Fatalf("unzip: %v", err)
+	}
+	if filepath.Base(root) != "bundle" {
+		t.Fatalf("expected top-level dir 'bundle', got %s", root)
+	}
+	if _, err := os.Stat(filepath.Join(root, "index.html")); err != nil {
+		t.Fatalf("expected index.html to be extracted: %v", err)
+	}
+}
+
+func TestUnzipRejectsPathTraversal(t *testing.T) {
+	zipPath := buildZip(t, map[string][]byte{
+		"../evil.txt": []byte("pwned"),
+	}, nil)
+
+	if _, err := unzip(zipPath, filepath.Join(filepath.Dir(zipPath), "extracted")); err == nil {
+		t.Fatal("unzip: expected error for a path-traversal entry")
+	}
+}
+
+func TestUnzipRejectsSymlinks(t *testing.T) {
+	zipPath := buildZip(t, map[string][]byte{
+		"bundle/index.html": []byte("<html></html>"),
+	}, map[string]string{
+		"bundle/evil-link": "/etc/passwd",
+	})
+
+	if _, err := unzip(zipPath, filepath.Join(filepath.Dir(zipPath), "extracted")); err == nil {
+		t.Fatal("unzip: expected error for a symlink entry")
+	}
+}
+
+func TestUnzipRejectsOversizedEntry(t *testing.T) {
+	zipPath := buildZip(t, map[string][]byte{
+		"bundle/big.bin": bytes.Repeat([]byte{0}, maxUIEntrySize+1),
+	}, nil)
+
+	if _, err := unzip(zipPath, filepath.Join(filepath.Dir(zipPath), "extracted")); err == nil {
+		t.Fatal("unzip: expected error for an entry over the per-file size limit")
+	}
+}
+
+func TestVerifyUIManifest(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	uiUpdateKeysM.Lock()
+	savedKeys := uiUpdateKeys
+	uiUpdateKeys = []ed25519.PublicKey{pub}
+	uiUpdateKeysM.Unlock()
+	t.Cleanup(func() {
+		uiUpdateKeysM.Lock()
+		uiUpdateKeys = savedKeys
+		uiUpdateKeysM.Unlock()
+	})
+
+	zipData := []byte("fake zip contents")
+	sum := sha256.Sum256(zipData)
+	version := "v1.2.3"
+	message := append(append([]byte{}, sum[:]...), []byte(version)...)
+	sig := ed25519.Sign(priv, message)
+
+	good := &uiManifest{
+		Version:   version,
+		SHA256:    hex.EncodeToString(sum[:]),
+		Signature: base64.StdEncoding.EncodeToString(sig),
+	}
+	if err := verifyUIManifest(good, zipData); err != nil {
+		t.Fatalf("verifyUIManifest: expected success, got %v", err)
+	}
+
+	otherSum := sha256.Sum256([]byte("other"))
+	wrongHash := *good
+	wrongHash.SHA256 = hex.EncodeToString(otherSum[:])
+	if err := verifyUIManifest(&wrongHash, zipData); err == nil {
+		t.Error("verifyUIManifest: expected sha256 mismatch error")
+	}
+
+	tamperedSig := *good
+	otherSig := ed25519.Sign(priv, []byte("not the real message"))
+	tamperedSig.Signature = base64.StdEncoding.EncodeToString(otherSig)
+	if err := verifyUIManifest(&tamperedSig, zipData); err == nil {
+		t.Error("verifyUIManifest: expected signature verification failure")
+	}
+}